@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// newElasticHTTPClient builds the *http.Client passed to
+// elastic.SetHttpClient, layering TLS and an auth.type-specific
+// RoundTripper (basic, api_key, bearer, or AWS SigV4) over the default
+// transport. Without this, the client can only talk to an unauthenticated,
+// plain-HTTP cluster.
+func newElasticHTTPClient(opts options) (*http.Client, error) {
+	tlsConfig, err := buildTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Base on a clone of http.DefaultTransport rather than a zero-value
+	// http.Transport, which has no Proxy field and would silently stop
+	// honoring HTTP_PROXY/HTTPS_PROXY/NO_PROXY for every run. Clone (rather
+	// than a plain *t dereference) avoids copying the sync.Mutex embedded
+	// in http.Transport.
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = tlsConfig
+	var transport http.RoundTripper = base
+
+	switch opts.Auth.Type {
+	case "":
+		// no auth configured
+
+	case "basic":
+		transport = &basicAuthTransport{
+			username: opts.Auth.Username,
+			password: opts.Auth.Password,
+			base:     transport,
+		}
+
+	case "api_key":
+		transport = &headerTransport{header: "Authorization", value: "ApiKey " + opts.Auth.Key, base: transport}
+
+	case "bearer":
+		transport = &headerTransport{header: "Authorization", value: "Bearer " + opts.Auth.Token, base: transport}
+
+	case "aws":
+		creds := credentials.NewStaticCredentials(opts.Auth.AWS.AccessKey, opts.Auth.AWS.SecretKey, "")
+		transport = &sigv4Transport{
+			signer:  v4.NewSigner(creds),
+			region:  opts.Auth.AWS.Region,
+			service: opts.Auth.AWS.Service,
+			base:    transport,
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown auth.type %q", opts.Auth.Type)
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+func buildTLSConfig(opts options) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.TLS.InsecureSkipVerify}
+
+	if opts.TLS.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading tls.ca_file: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls.ca_file %s contains no usable certificates", opts.TLS.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.TLS.CertFile != "" && opts.TLS.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLS.CertFile, opts.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading tls.cert_file/tls.key_file: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// basicAuthTransport sets HTTP basic auth on every outgoing request.
+type basicAuthTransport struct {
+	username, password string
+	base               http.RoundTripper
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.SetBasicAuth(t.username, t.password)
+	return t.base.RoundTrip(req)
+}
+
+// headerTransport sets a single static header on every outgoing request;
+// used for both api_key and bearer auth, which only differ in the header
+// value's prefix.
+type headerTransport struct {
+	header, value string
+	base          http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set(t.header, t.value)
+	return t.base.RoundTrip(req)
+}
+
+// sigv4Transport signs every outgoing request with AWS Signature Version
+// 4, as required by Amazon OpenSearch/Elasticsearch Service when not
+// fronted by a VPC endpoint with IAM auth disabled.
+type sigv4Transport struct {
+	signer  *v4.Signer
+	region  string
+	service string
+	base    http.RoundTripper
+}
+
+func (t *sigv4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+		body = b
+	}
+
+	if _, err := t.signer.Sign(req, bytes.NewReader(body), t.service, t.region, time.Now()); err != nil {
+		return nil, fmt.Errorf("signing request with sigv4: %s", err.Error())
+	}
+
+	return t.base.RoundTrip(req)
+}
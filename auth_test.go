@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+type captureTransport struct {
+	req *http.Request
+}
+
+func (t *captureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.req = req
+	return &http.Response{StatusCode: http.StatusOK}, nil
+}
+
+func TestBasicAuthTransportSetsCredentials(t *testing.T) {
+	capture := &captureTransport{}
+	transport := &basicAuthTransport{username: "alice", password: "secret", base: capture}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+
+	username, password, ok := capture.req.BasicAuth()
+	if !ok || username != "alice" || password != "secret" {
+		t.Errorf("BasicAuth() = (%q, %q, %v), want (\"alice\", \"secret\", true)", username, password, ok)
+	}
+}
+
+func TestHeaderTransportSetsHeader(t *testing.T) {
+	capture := &captureTransport{}
+	transport := &headerTransport{header: "Authorization", value: "Bearer xyz", base: capture}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+
+	if got := capture.req.Header.Get("Authorization"); got != "Bearer xyz" {
+		t.Errorf("Authorization header = %q, want %q", got, "Bearer xyz")
+	}
+}
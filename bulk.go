@@ -0,0 +1,359 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/olivere/elastic.v2"
+)
+
+// bulkRequest pairs a queued bulk request with its approximate size in
+// bytes, so a failed item can be resubmitted without re-reading indexQ.
+type bulkRequest struct {
+	req  elastic.BulkableRequest
+	size int
+}
+
+// bulkProcessor batches documents into elastic.BulkService requests and
+// flushes them on whichever threshold is hit first: action count, byte
+// size, or flush_interval. It replaces the old bare "flush every
+// MaxBulkActions" loop with retry/backoff on transient failures and a
+// backpressure signal producers can watch.
+type bulkProcessor struct {
+	client *elastic.Client
+	opts   options
+
+	mu      sync.Mutex
+	pending []bulkRequest
+	bytes   int
+
+	retryAttempts  int
+	initialBackoff time.Duration
+
+	flushTicker *time.Ticker
+	done        chan struct{}
+	wg          sync.WaitGroup
+
+	// backoff is open (readable) while the processor is healthy. When the
+	// failure rate trips bulkFailureThreshold within bulkFailureWindow, it
+	// is closed so producer goroutines blocked on <-backoff stall until
+	// things recover, throttling Postgres reads instead of growing indexQ
+	// without bound.
+	backoffMu sync.Mutex
+	backoff   chan struct{}
+
+	recentFailures []time.Time
+}
+
+const (
+	bulkFailureThreshold = 10
+	bulkFailureWindow    = 30 * time.Second
+)
+
+func newBulkProcessor(client *elastic.Client, opts options) *bulkProcessor {
+	flushInterval := 5 * time.Second
+	if opts.FlushInterval != "" {
+		if d, err := time.ParseDuration(opts.FlushInterval); err == nil {
+			flushInterval = d
+		} else {
+			log.Printf("invalid flush_interval %q, using default %s", opts.FlushInterval, flushInterval)
+		}
+	}
+
+	initialBackoff := 500 * time.Millisecond
+	if opts.RetryInitialBackoff != "" {
+		if d, err := time.ParseDuration(opts.RetryInitialBackoff); err == nil {
+			initialBackoff = d
+		} else {
+			log.Printf("invalid retry_initial_backoff %q, using default %s", opts.RetryInitialBackoff, initialBackoff)
+		}
+	}
+
+	retryAttempts := opts.RetryAttempts
+	if retryAttempts == 0 {
+		retryAttempts = 5
+	}
+
+	p := &bulkProcessor{
+		client:         client,
+		opts:           opts,
+		retryAttempts:  retryAttempts,
+		initialBackoff: initialBackoff,
+		flushTicker:    time.NewTicker(flushInterval),
+		done:           make(chan struct{}),
+		backoff:        make(chan struct{}),
+	}
+	close(p.backoff) // start open: healthy
+
+	p.wg.Add(1)
+	go p.run()
+
+	return p
+}
+
+// Backoff returns a channel that is open while the processor is healthy and
+// closed while it is backing off. Producers should select on it (or do a
+// zero-cost <-p.Backoff()) before pushing to indexQ.
+func (p *bulkProcessor) Backoff() <-chan struct{} {
+	p.backoffMu.Lock()
+	defer p.backoffMu.Unlock()
+	return p.backoff
+}
+
+func (p *bulkProcessor) run() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.flushTicker.C:
+			p.flush()
+		case <-p.done:
+			p.flushTicker.Stop()
+			p.flush()
+			return
+		}
+	}
+}
+
+// Submit queues doc for the given index/id/routing/opType, flushing
+// immediately if the count or byte size thresholds configured via
+// max_bulk_actions / bulk_size_bytes are hit. id and routing may be empty,
+// in which case Elasticsearch assigns an id and routes by id as usual.
+// opType is one of "create", "index", or "upsert".
+func (p *bulkProcessor) Submit(index, id, routing, opType, doc string) {
+	var req elastic.BulkableRequest
+
+	if opType == "upsert" {
+		// BulkUpdateRequest.Doc marshals whatever it's given straight into
+		// the "doc" field, so passing doc as a raw JSON string would wrap
+		// it as one escaped string instead of the row's actual fields;
+		// decode it into a map first, same as every other _id/routing
+		// call site (see decodeRow in router.go).
+		row, err := decodeRow(doc)
+		if err != nil {
+			log.Println("bulk: decode doc for upsert:", err.Error())
+			atomic.AddUint64(&failed, 1)
+			docsFailedTotal.WithLabelValues("decode_error").Inc()
+			return
+		}
+
+		u := elastic.NewBulkUpdateRequest().Index(index).Type(p.opts.Type).Doc(row).DocAsUpsert(true)
+		if id != "" {
+			u = u.Id(id)
+		}
+		if routing != "" {
+			u = u.Routing(routing)
+		}
+		req = u
+	} else {
+		if opType == "" {
+			opType = "create"
+		}
+		i := elastic.NewBulkIndexRequest().Index(index).Type(p.opts.Type).OpType(opType).Doc(doc)
+		if id != "" {
+			i = i.Id(id)
+		}
+		if routing != "" {
+			i = i.Routing(routing)
+		}
+		req = i
+	}
+
+	p.enqueue(req, len(doc))
+}
+
+// Delete queues removal of the document with the given id from index.
+func (p *bulkProcessor) Delete(index, id string) {
+	req := elastic.NewBulkDeleteRequest().Index(index).Type(p.opts.Type).Id(id)
+	p.enqueue(req, 0)
+}
+
+func (p *bulkProcessor) enqueue(req elastic.BulkableRequest, size int) {
+	p.mu.Lock()
+	p.pending = append(p.pending, bulkRequest{req: req, size: size})
+	p.bytes += size
+	flush := len(p.pending) >= p.opts.MaxBulkActions ||
+		(p.opts.BulkSizeBytes > 0 && p.bytes >= p.opts.BulkSizeBytes)
+	p.mu.Unlock()
+
+	if flush {
+		p.flush()
+	}
+}
+
+// Stop flushes any remaining documents and stops the background ticker.
+func (p *bulkProcessor) Stop() {
+	close(p.done)
+	p.wg.Wait()
+}
+
+func (p *bulkProcessor) flush() {
+	p.mu.Lock()
+	if len(p.pending) == 0 {
+		p.mu.Unlock()
+		return
+	}
+	batch := p.pending
+	p.pending = nil
+	p.bytes = 0
+	p.mu.Unlock()
+
+	p.sendWithRetry(batch)
+}
+
+// sendWithRetry submits batch, resubmitting only the items that failed with
+// a transient status (429, 503, or a transport error) using exponential
+// backoff with jitter. 409 version conflicts are treated as already applied
+// and dropped rather than retried.
+func (p *bulkProcessor) sendWithRetry(batch []bulkRequest) {
+	for attempt := 0; attempt <= p.retryAttempts && len(batch) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(jitteredBackoff(attempt-1, p.initialBackoff))
+		}
+
+		svc := elastic.NewBulkService(p.client).Index(p.opts.Index).Type(p.opts.Type)
+		for _, b := range batch {
+			svc.Add(b.req)
+		}
+
+		start := time.Now()
+		response, err := svc.Do()
+		bulkLatencySeconds.Observe(time.Since(start).Seconds())
+		bulkRequestsTotal.Inc()
+		if err != nil {
+			p.recordFailure(len(batch))
+			if attempt == p.retryAttempts {
+				atomic.AddUint64(&failed, uint64(len(batch)))
+				docsFailedTotal.WithLabelValues("transport_error").Add(float64(len(batch)))
+				status <- 1
+				return
+			}
+			continue
+		}
+
+		// response.Items is positionally aligned with batch; the
+		// Succeeded()/Failed() helpers filter the list down, so their
+		// indices do NOT correspond to batch indices and must not be used
+		// to decide what to resubmit.
+		var retry []bulkRequest
+		var succeededCount, permanentlyFailed int
+		for i, itemMap := range response.Items {
+			item := bulkResponseItem(itemMap)
+			if item == nil {
+				continue
+			}
+			switch {
+			case item.Status >= 200 && item.Status < 300:
+				succeededCount++
+			case item.Status == 409:
+				// already applied, not a real failure
+			case isRetryableStatus(item.Status):
+				retry = append(retry, batch[i])
+			default:
+				permanentlyFailed++
+			}
+		}
+
+		atomic.AddUint64(&succeded, uint64(succeededCount))
+		docsIndexedTotal.Add(float64(succeededCount))
+
+		if permanentlyFailed > 0 {
+			atomic.AddUint64(&failed, uint64(permanentlyFailed))
+			docsFailedTotal.WithLabelValues("permanent").Add(float64(permanentlyFailed))
+			status <- 1
+		}
+
+		if len(retry) > 0 {
+			p.recordFailure(len(retry))
+		}
+
+		batch = retry
+	}
+
+	if len(batch) > 0 {
+		// Retries exhausted.
+		atomic.AddUint64(&failed, uint64(len(batch)))
+		docsFailedTotal.WithLabelValues("retries_exhausted").Add(float64(len(batch)))
+		status <- 1
+	}
+}
+
+// bulkResponseItem unwraps one entry of BulkResponse.Items, each of which
+// is a single-key map from action name ("index"/"create"/"update"/
+// "delete") to its result.
+func bulkResponseItem(m map[string]*elastic.BulkResponseItem) *elastic.BulkResponseItem {
+	for _, item := range m {
+		return item
+	}
+	return nil
+}
+
+func isRetryableStatus(httpStatus int) bool {
+	return httpStatus == 429 || httpStatus == 503 || httpStatus == 0
+}
+
+func jitteredBackoff(attempt int, initial time.Duration) time.Duration {
+	backoff := initial << uint(attempt)
+	jitter := time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+	return backoff + jitter
+}
+
+// recordFailure tracks failures within bulkFailureWindow and trips the
+// backoff gate closed once bulkFailureThreshold is exceeded, reopening it
+// once the window has rolled past without further failures.
+func (p *bulkProcessor) recordFailure(n int) {
+	now := time.Now()
+
+	p.backoffMu.Lock()
+	defer p.backoffMu.Unlock()
+
+	cutoff := now.Add(-bulkFailureWindow)
+	fresh := p.recentFailures[:0]
+	for _, t := range p.recentFailures {
+		if t.After(cutoff) {
+			fresh = append(fresh, t)
+		}
+	}
+	for i := 0; i < n; i++ {
+		fresh = append(fresh, now)
+	}
+	p.recentFailures = fresh
+
+	if len(p.recentFailures) > bulkFailureThreshold {
+		select {
+		case <-p.backoff:
+			p.backoff = make(chan struct{})
+			bulkBackoffActive.Set(1)
+		default:
+			// already closed
+		}
+		go p.reopenAfterWindow()
+	}
+}
+
+func (p *bulkProcessor) reopenAfterWindow() {
+	time.Sleep(bulkFailureWindow)
+
+	p.backoffMu.Lock()
+	defer p.backoffMu.Unlock()
+
+	cutoff := time.Now().Add(-bulkFailureWindow)
+	stillFailing := false
+	for _, t := range p.recentFailures {
+		if t.After(cutoff) {
+			stillFailing = true
+			break
+		}
+	}
+	if !stillFailing {
+		select {
+		case <-p.backoff:
+			// already open
+		default:
+			close(p.backoff)
+			bulkBackoffActive.Set(0)
+		}
+	}
+}
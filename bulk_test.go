@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/olivere/elastic.v2"
+)
+
+func TestJitteredBackoffGrowsExponentiallyWithJitterBounded(t *testing.T) {
+	initial := 100 * time.Millisecond
+
+	for attempt := 0; attempt < 4; attempt++ {
+		base := initial << uint(attempt)
+		maxJitter := base / 2
+
+		for i := 0; i < 20; i++ {
+			got := jitteredBackoff(attempt, initial)
+			if got < base || got > base+maxJitter {
+				t.Errorf("jitteredBackoff(%d, %s) = %s, want in [%s, %s]", attempt, initial, got, base, base+maxJitter)
+			}
+		}
+	}
+}
+
+func TestIsRetryableStatus(t *testing.T) {
+	cases := map[int]bool{
+		429: true,
+		503: true,
+		0:   true,
+		200: false,
+		409: false,
+		400: false,
+	}
+	for status, want := range cases {
+		if got := isRetryableStatus(status); got != want {
+			t.Errorf("isRetryableStatus(%d) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+// TestUpsertRequestDocIsAnObjectNotAString guards against passing the raw
+// JSON doc string straight to BulkUpdateRequest.Doc, which wraps it as one
+// escaped-string field instead of the row's actual columns.
+func TestUpsertRequestDocIsAnObjectNotAString(t *testing.T) {
+	row, err := decodeRow(`{"id":1,"name":"widget"}`)
+	if err != nil {
+		t.Fatalf("decodeRow() error = %v", err)
+	}
+
+	req := elastic.NewBulkUpdateRequest().Index("widgets").Type("_doc").Id("1").Doc(row).DocAsUpsert(true)
+
+	lines, err := req.Source()
+	if err != nil {
+		t.Fatalf("Source() error = %v", err)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("Source() returned %d lines, want 2", len(lines))
+	}
+
+	var body struct {
+		Doc map[string]interface{} `json:"doc"`
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &body); err != nil {
+		t.Fatalf("Source()[1] = %q is not a JSON object: %v", lines[1], err)
+	}
+	if body.Doc["name"] != "widget" {
+		t.Errorf("Source()[1] doc.name = %v, want %q", body.Doc["name"], "widget")
+	}
+}
+
+// TestSendWithRetryUsesPositionalItemsNotFailed stubs the Elasticsearch
+// _bulk endpoint with a 4-item response mixing a success, a 409, a
+// retryable 429, and a permanent 500, then a second response (for the
+// reissued 429 item only) that succeeds. This is the scenario commit
+// 2230e9a fixed: resubmitting by response.Failed() index instead of the
+// positionally-aligned response.Items would retry/count the wrong item.
+func TestSendWithRetryUsesPositionalItemsNotFailed(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Write([]byte(`{"took":1,"errors":true,"items":[
+				{"create":{"status":201}},
+				{"create":{"status":409}},
+				{"create":{"status":429}},
+				{"create":{"status":500,"error":"boom"}}
+			]}`))
+			return
+		}
+		w.Write([]byte(`{"took":1,"errors":false,"items":[{"create":{"status":201}}]}`))
+	}))
+	defer server.Close()
+
+	client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatalf("elastic.NewClient() error = %v", err)
+	}
+
+	// sendWithRetry reports permanent failures on the unbuffered status
+	// channel; drain it so the call doesn't block on a reader nobody started.
+	drainDone := make(chan struct{})
+	defer close(drainDone)
+	go func() {
+		for {
+			select {
+			case <-status:
+			case <-drainDone:
+				return
+			}
+		}
+	}()
+
+	p := &bulkProcessor{
+		client:         client,
+		opts:           options{Index: "widgets", Type: "_doc"},
+		retryAttempts:  1,
+		initialBackoff: time.Millisecond,
+		backoff:        make(chan struct{}),
+	}
+	close(p.backoff)
+
+	succededBefore := atomic.LoadUint64(&succeded)
+	failedBefore := atomic.LoadUint64(&failed)
+
+	batch := make([]bulkRequest, 4)
+	for i := range batch {
+		batch[i] = bulkRequest{req: elastic.NewBulkIndexRequest().Index("widgets").Type("_doc").OpType("create").Doc(`{}`)}
+	}
+	p.sendWithRetry(batch)
+
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Fatalf("server received %d requests, want 2 (initial + one retry of the 429 item)", got)
+	}
+	// 1 succeeds on the first pass (201) + the retried 429 succeeding on
+	// the second pass = 2; the 409 is dropped as already-applied, and the
+	// 500 is a permanent failure.
+	if got := atomic.LoadUint64(&succeded) - succededBefore; got != 2 {
+		t.Errorf("succeded += %d, want 2", got)
+	}
+	if got := atomic.LoadUint64(&failed) - failedBefore; got != 1 {
+		t.Errorf("failed += %d, want 1", got)
+	}
+}
+
+func TestBulkResponseItem(t *testing.T) {
+	item := &elastic.BulkResponseItem{Status: 201}
+	m := map[string]*elastic.BulkResponseItem{"create": item}
+
+	if got := bulkResponseItem(m); got != item {
+		t.Errorf("bulkResponseItem() = %v, want %v", got, item)
+	}
+
+	if got := bulkResponseItem(nil); got != nil {
+		t.Errorf("bulkResponseItem(nil) = %v, want nil", got)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// walChange is one entry in a wal2json "change" array: an insert, update,
+// or delete decoded off the replication slot.
+type walChange struct {
+	Kind         string        `json:"kind"`
+	Schema       string        `json:"schema"`
+	Table        string        `json:"table"`
+	ColumnNames  []string      `json:"columnnames"`
+	ColumnValues []interface{} `json:"columnvalues"`
+	OldKeys      struct {
+		KeyNames  []string      `json:"keynames"`
+		KeyValues []interface{} `json:"keyvalues"`
+	} `json:"oldkeys"`
+}
+
+type walMessage struct {
+	Change []walChange `json:"change"`
+}
+
+const standbyStatusInterval = 10 * time.Second
+
+// runCDC opens a logical replication slot (wal2json output plugin) and
+// streams INSERT/UPDATE/DELETE events into Elasticsearch as they happen,
+// the same way Monstache tails the MongoDB oplog. The last confirmed LSN is
+// persisted to opts.CDC.StateFile so a restart resumes without gaps or a
+// full re-snapshot.
+//
+// On a resume (a checkpointed LSN already exists) streaming picks up
+// directly from it and the initial snapshot is skipped entirely. On a
+// first run, the replication slot is created *before* the snapshot query
+// runs, and its consistent_point - the LSN as of which the slot's snapshot
+// is valid - is what streaming starts from once the snapshot completes.
+// That ordering closes the gap a snapshot-then-create-slot sequence would
+// leave: any write landing between reading the snapshot and creating the
+// slot would otherwise be captured by neither.
+func runCDC(db *sql.DB, opts options, processor *bulkProcessor, workers int) {
+
+	slotName := opts.CDC.SlotName
+	if slotName == "" {
+		slotName = fmt.Sprintf("%s_p2e_slot", opts.DB.Table)
+	}
+
+	stateFile := opts.CDC.StateFile
+	if stateFile == "" {
+		stateFile = fmt.Sprintf(".%s.lsn", slotName)
+	}
+
+	router, err := newDocRouter(opts)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	// A delete event's row is built from oldkeys alone, which by default is
+	// just the primary key (Postgres's default REPLICA IDENTITY). If
+	// id_column/index_template reference any other column, that lookup
+	// misses silently - id_column falls back to the wrong column's value
+	// and index_template errors out (see the missingkey=error comment in
+	// router.go), either way leaving the delete unroutable. Requiring FULL
+	// up front catches this at startup instead of row-by-row in the stream.
+	if opts.IDColumn != "" || opts.IndexTemplate != "" {
+		if err := requireFullReplicaIdentity(db, opts.DB.Table); err != nil {
+			log.Fatalln(err.Error())
+		}
+	}
+
+	ctx := context.Background()
+
+	connStr := fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s replication=database", opts.DB.Host, opts.DB.Port, opts.DB.Database, opts.DB.User, opts.DB.Password)
+	conn, err := pgconn.Connect(ctx, connStr)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer conn.Close(ctx)
+
+	startLSN, resuming := loadLSN(stateFile)
+	if !resuming {
+		slot, err := pglogrepl.CreateReplicationSlot(ctx, conn, slotName, "wal2json", pglogrepl.CreateReplicationSlotOptions{})
+		if err != nil {
+			log.Fatalln(fmt.Sprintf("cdc: create_replication_slot %s: %s", slotName, err.Error()))
+		}
+
+		startLSN, err = pglogrepl.ParseLSN(slot.ConsistentPoint)
+		if err != nil {
+			log.Fatalln("cdc: parsing slot consistent_point:", err.Error())
+		}
+
+		log.Println("cdc: running initial snapshot up to", startLSN)
+		runSnapshot(db, opts, processor, workers)
+		saveLSN(stateFile, startLSN)
+	} else {
+		log.Println("cdc: resuming from checkpointed LSN", startLSN, "- skipping initial snapshot")
+	}
+
+	err = pglogrepl.StartReplication(ctx, conn, slotName, startLSN, pglogrepl.StartReplicationOptions{
+		PluginArgs: []string{"\"include-lsn\" 'true'"},
+	})
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	lastWritten := startLSN
+	nextStandby := time.Now().Add(standbyStatusInterval)
+
+	for {
+		if time.Now().After(nextStandby) {
+			if err := pglogrepl.SendStandbyStatusUpdate(ctx, conn, pglogrepl.StandbyStatusUpdate{WALWritePosition: lastWritten}); err != nil {
+				log.Println("cdc: standby status update failed:", err.Error())
+			}
+			saveLSN(stateFile, lastWritten)
+			nextStandby = time.Now().Add(standbyStatusInterval)
+		}
+
+		recvCtx, cancel := context.WithTimeout(ctx, standbyStatusInterval)
+		msg, err := conn.ReceiveMessage(recvCtx)
+		cancel()
+		if err != nil {
+			if recvCtx.Err() != nil {
+				continue // idle timeout, loop back around to send a standby update
+			}
+			log.Fatalln(err.Error())
+		}
+
+		cd, ok := msg.(*pgproto3.CopyData)
+		if !ok || len(cd.Data) == 0 {
+			continue
+		}
+
+		switch cd.Data[0] {
+		case pglogrepl.XLogDataByteID:
+			xld, err := pglogrepl.ParseXLogData(cd.Data[1:])
+			if err != nil {
+				log.Println("cdc: parse xlogdata:", err.Error())
+				continue
+			}
+			handleWALData(xld.WALData, opts, processor, router)
+			lastWritten = xld.WALStart + pglogrepl.LSN(len(xld.WALData))
+
+		case pglogrepl.PrimaryKeepaliveMessageByteID:
+			pkm, err := pglogrepl.ParsePrimaryKeepaliveMessage(cd.Data[1:])
+			if err == nil && pkm.ReplyRequested {
+				nextStandby = time.Time{}
+			}
+		}
+	}
+}
+
+// handleWALData decodes a wal2json change set and applies each row change to
+// the bulk processor, routed through the same docRouter the snapshot path
+// uses so routing_column/index_template/op_type behave identically in CDC
+// mode instead of always hardcoding opts.Index/"" routing/"index" op type.
+func handleWALData(data []byte, opts options, processor *bulkProcessor, router *docRouter) {
+	var msg walMessage
+	// UseNumber preserves exact bigint/bigserial id precision; the default
+	// decode into interface{} would turn a value like 123456789012345 into
+	// a float64 and mangle it into scientific notation.
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&msg); err != nil {
+		log.Println("cdc: decode wal2json message:", err.Error())
+		return
+	}
+
+	for _, change := range msg.Change {
+		if !walChangeMatchesTable(change, opts.DB.Table) {
+			continue
+		}
+		postgresRowsReadTotal.Inc()
+
+		switch change.Kind {
+		case "insert", "update":
+			row := make(map[string]interface{}, len(change.ColumnNames))
+			for i, name := range change.ColumnNames {
+				row[name] = change.ColumnValues[i]
+			}
+
+			doc, err := json.Marshal(row)
+			if err != nil {
+				log.Println("cdc: marshal row:", err.Error())
+				continue
+			}
+
+			idx, id, routing, opType, err := router.route(string(doc))
+			if err != nil {
+				log.Println("cdc: routing row:", err.Error())
+				continue
+			}
+			if id == "" {
+				id = primaryKeyValue(row, change, opts)
+			}
+			if opts.OpType == "" {
+				// Unlike the snapshot path, CDC sees the same row again on
+				// every update, so "create" (router's default) would 409
+				// from the second event on; "index" replaces in place as
+				// it always has for CDC, unless op_type is set explicitly.
+				opType = "index"
+			}
+			processor.Submit(idx, id, routing, opType, string(doc))
+
+		case "delete":
+			row := make(map[string]interface{}, len(change.OldKeys.KeyNames))
+			for i, name := range change.OldKeys.KeyNames {
+				row[name] = change.OldKeys.KeyValues[i]
+			}
+
+			doc, err := json.Marshal(row)
+			if err != nil {
+				log.Println("cdc: marshal row:", err.Error())
+				continue
+			}
+
+			idx, id, _, _, err := router.route(string(doc))
+			if err != nil {
+				log.Println("cdc: routing row:", err.Error())
+				continue
+			}
+			if id == "" {
+				id = primaryKeyValue(row, change, opts)
+			}
+			processor.Delete(idx, id)
+		}
+	}
+}
+
+// walChangeMatchesTable compares a wal2json change against the configured
+// db.table, which (like every other %s-substituted FROM opts.DB.Table in
+// main.go/scan.go) may be schema-qualified, e.g. "public.orders". wal2json
+// reports the bare table name and schema as separate fields, so a naive
+// change.Table != opts.DB.Table comparison never matches a qualified
+// db.table and CDC mode silently streams nothing.
+func walChangeMatchesTable(change walChange, table string) bool {
+	if i := strings.LastIndex(table, "."); i >= 0 {
+		return change.Schema == table[:i] && change.Table == table[i+1:]
+	}
+	return change.Table == table
+}
+
+// primaryKeyValue picks the document id for a WAL change. If id_column is
+// configured it wins; otherwise wal2json's replica identity (the table's
+// primary key, by default) in oldkeys covers updates/deletes, and for
+// inserts - where oldkeys isn't present - it falls back to the first
+// column, which wal2json lists in table definition order and is almost
+// always the primary key.
+func primaryKeyValue(row map[string]interface{}, change walChange, opts options) string {
+	if opts.IDColumn != "" {
+		if v, ok := row[opts.IDColumn]; ok {
+			return columnString(v)
+		}
+	}
+	if len(change.OldKeys.KeyNames) > 0 {
+		return columnString(change.OldKeys.KeyValues[0])
+	}
+	for _, name := range change.ColumnNames {
+		return columnString(row[name])
+	}
+	return ""
+}
+
+// requireFullReplicaIdentity errors unless table has REPLICA IDENTITY FULL,
+// which is what makes wal2json include every column (not just the primary
+// key) in a delete event's oldkeys - required for id_column/index_template
+// to resolve correctly on deletes.
+func requireFullReplicaIdentity(db *sql.DB, table string) error {
+	var ident string
+	if err := db.QueryRow(`SELECT relreplident FROM pg_class WHERE oid = $1::regclass`, table).Scan(&ident); err != nil {
+		return fmt.Errorf("cdc: checking replica identity for %s: %s", table, err.Error())
+	}
+	if ident != "f" {
+		return fmt.Errorf("cdc: id_column/index_template need every column available on delete, but %s has REPLICA IDENTITY %s (default only carries the primary key into oldkeys) - run \"ALTER TABLE %s REPLICA IDENTITY FULL\" first", table, replicaIdentityName(ident), table)
+	}
+	return nil
+}
+
+// replicaIdentityName maps pg_class.relreplident's single-character code to
+// the name used in REPLICA IDENTITY DDL/docs.
+func replicaIdentityName(code string) string {
+	switch code {
+	case "d":
+		return "DEFAULT"
+	case "n":
+		return "NOTHING"
+	case "i":
+		return "USING INDEX"
+	case "f":
+		return "FULL"
+	default:
+		return code
+	}
+}
+
+func loadLSN(stateFile string) (pglogrepl.LSN, bool) {
+	raw, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return 0, false
+	}
+	lsn, err := pglogrepl.ParseLSN(string(raw))
+	if err != nil {
+		return 0, false
+	}
+	return lsn, true
+}
+
+func saveLSN(stateFile string, lsn pglogrepl.LSN) {
+	if err := ioutil.WriteFile(stateFile, []byte(lsn.String()), 0644); err != nil {
+		log.Println("cdc: persist lsn:", err.Error())
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestPrimaryKeyValueIDColumn(t *testing.T) {
+	opts := options{IDColumn: "id"}
+	row := map[string]interface{}{"id": "42", "name": "alice"}
+
+	got := primaryKeyValue(row, walChange{}, opts)
+	if got != "42" {
+		t.Errorf("primaryKeyValue() = %q, want %q", got, "42")
+	}
+}
+
+func TestPrimaryKeyValueFallsBackToOldKeys(t *testing.T) {
+	opts := options{}
+	change := walChange{}
+	change.OldKeys.KeyNames = []string{"id"}
+	change.OldKeys.KeyValues = []interface{}{"7"}
+	row := map[string]interface{}{"id": "7"}
+
+	got := primaryKeyValue(row, change, opts)
+	if got != "7" {
+		t.Errorf("primaryKeyValue() = %q, want %q", got, "7")
+	}
+}
+
+func TestPrimaryKeyValueFallsBackToFirstColumn(t *testing.T) {
+	opts := options{}
+	change := walChange{ColumnNames: []string{"id", "name"}}
+	row := map[string]interface{}{"id": "9", "name": "bob"}
+
+	got := primaryKeyValue(row, change, opts)
+	if got != "9" {
+		t.Errorf("primaryKeyValue() = %q, want %q", got, "9")
+	}
+}
+
+func TestWALChangeMatchesTableUnqualified(t *testing.T) {
+	change := walChange{Schema: "public", Table: "orders"}
+	if !walChangeMatchesTable(change, "orders") {
+		t.Error("walChangeMatchesTable() = false, want true for unqualified db.table")
+	}
+	if walChangeMatchesTable(change, "items") {
+		t.Error("walChangeMatchesTable() = true, want false for a different table")
+	}
+}
+
+func TestWALChangeMatchesTableSchemaQualified(t *testing.T) {
+	change := walChange{Schema: "public", Table: "orders"}
+	if !walChangeMatchesTable(change, "public.orders") {
+		t.Error("walChangeMatchesTable() = false, want true for matching schema.table")
+	}
+	if walChangeMatchesTable(change, "other.orders") {
+		t.Error("walChangeMatchesTable() = true, want false for a different schema")
+	}
+}
+
+func TestReplicaIdentityName(t *testing.T) {
+	cases := map[string]string{
+		"d": "DEFAULT",
+		"n": "NOTHING",
+		"i": "USING INDEX",
+		"f": "FULL",
+		"?": "?",
+	}
+	for code, want := range cases {
+		if got := replicaIdentityName(code); got != want {
+			t.Errorf("replicaIdentityName(%q) = %q, want %q", code, got, want)
+		}
+	}
+}
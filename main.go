@@ -9,10 +9,12 @@ import (
 	"gopkg.in/olivere/elastic.v2"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"text/template"
 )
 
 // Options
@@ -31,41 +33,96 @@ type options struct {
 	Index    string            `json:"index"`
 	Type     string            `json:"type"`
 	Mappings []json.RawMessage `json:"mappings"`
+
+	FlushInterval       string `json:"flush_interval"`
+	BulkSizeBytes       int    `json:"bulk_size_bytes"`
+	RetryAttempts       int    `json:"retry_attempts"`
+	RetryInitialBackoff string `json:"retry_initial_backoff"`
+
+	// Mode selects between a one-shot snapshot (the default) and "cdc",
+	// which streams ongoing changes via logical replication after the
+	// initial snapshot completes.
+	Mode string `json:"mode"`
+	CDC  struct {
+		SlotName    string `json:"slot_name"`
+		Publication string `json:"publication"`
+		StateFile   string `json:"state_file"`
+	} `json:"cdc"`
+
+	// IDColumn and RoutingColumn name the row column to use for the
+	// document _id and routing value, respectively. IndexTemplate is a Go
+	// text/template evaluated per row against the row's columns (e.g.
+	// "logs-{{.created_at | date \"2006.01\"}}") and falls back to Index
+	// when empty. OpType is one of "create" (default), "index", or
+	// "upsert".
+	IDColumn      string `json:"id_column"`
+	RoutingColumn string `json:"routing_column"`
+	IndexTemplate string `json:"index_template"`
+	OpType        string `json:"op_type"`
+
+	// Slices splits the initial snapshot across that many concurrent
+	// reader goroutines (analogous to Elasticsearch sliced scroll).
+	// ResumeFromColumn, when set, lets an interrupted slice restart from
+	// the last emitted value instead of from the top; progress is
+	// checkpointed to SliceStateFile.
+	Slices           int    `json:"slices"`
+	ResumeFromColumn string `json:"resume_from"`
+	SliceStateFile   string `json:"slice_state_file"`
+
+	// Auth and TLS configure the HTTP client used to talk to
+	// Elasticsearch/OpenSearch, for clusters that require more than a bare
+	// URL (see buildHTTPClient in auth.go).
+	Auth struct {
+		Type     string `json:"type"` // "basic", "api_key", "bearer", "aws"
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Key      string `json:"key"`
+		Token    string `json:"token"`
+		AWS      struct {
+			Region    string `json:"region"`
+			Service   string `json:"service"`
+			AccessKey string `json:"access_key"`
+			SecretKey string `json:"secret_key"`
+		} `json:"aws"`
+	} `json:"auth"`
+	TLS struct {
+		CAFile             string `json:"ca_file"`
+		CertFile           string `json:"cert_file"`
+		KeyFile            string `json:"key_file"`
+		InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	} `json:"tls"`
+
+	// MetricsAddr, when set, starts a Prometheus /metrics server plus
+	// /healthz and /readyz on that address (e.g. ":9090").
+	MetricsAddr string `json:"metrics_addr"`
 }
 
 // Create buffered channel to send inserts through
 var indexQ chan string
 var status = make(chan int)
 
+// queueDepth mirrors len(indexQ) for the index_queue_depth metric without
+// reading the channel itself, since indexQ is reassigned/closed across
+// runs with no synchronization a reader goroutine could safely observe.
+var queueDepth int64
+
 // Global counters
 var succeded, failed uint64
 
-// Index worker function to insert docs
-func index(wg *sync.WaitGroup, opts options) {
-
-	// Connect client
-	client, err := elastic.NewClient(elastic.SetURL(opts.URI), elastic.SetSniff(false))
-
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-
-	// Create new bulk service request
-	bulkService := elastic.NewBulkService(client).Index(opts.Index).Type(opts.Type)
+// Index worker function to insert docs. Batching, flushing, and retries are
+// handled by the shared bulkProcessor; the worker derives the per-row
+// index/id/routing/op type via router and hands the rest off.
+func index(wg *sync.WaitGroup, processor *bulkProcessor, router *docRouter) {
 	for doc := range indexQ {
+		atomic.AddInt64(&queueDepth, -1)
 
-		//Add index to request
-		bIndex := elastic.NewBulkIndexRequest().Index(opts.Index).OpType("create").Doc(doc)
-		bulkService.Add(bIndex)
-
-		// Send request after MaxBulkActions limit is reached
-		if bulkService.NumberOfActions() > opts.MaxBulkActions-1 {
-			bulkResponse, _ := bulkService.Do()
-			atomic.AddUint64(&succeded, uint64(len(bulkResponse.Succeeded())))
-			atomic.AddUint64(&failed, uint64(len(bulkResponse.Failed())))
-			status <- 1
+		idx, id, routing, opType, err := router.route(doc)
+		if err != nil {
+			log.Println(err.Error())
+			atomic.AddUint64(&failed, 1)
+			continue
 		}
-
+		processor.Submit(idx, id, routing, opType, doc)
 	}
 
 	wg.Done()
@@ -114,6 +171,54 @@ func check(opts options) error {
 		return errors.New("No table found in options.")
 	}
 
+	if opts.Mode != "" && opts.Mode != "cdc" {
+		return errors.New("mode must be empty (one-shot snapshot) or \"cdc\".")
+	}
+
+	switch opts.OpType {
+	case "", "create", "index", "upsert":
+	default:
+		return errors.New("op_type must be one of \"create\", \"index\", or \"upsert\".")
+	}
+
+	if opts.IndexTemplate != "" {
+		if _, err := template.New("index_template").Funcs(templateFuncs).Parse(opts.IndexTemplate); err != nil {
+			return fmt.Errorf("parsing index_template: %s", err.Error())
+		}
+	}
+
+	if opts.Slices < 0 {
+		return errors.New("slices must not be negative.")
+	}
+
+	switch opts.Auth.Type {
+	case "":
+	case "basic":
+		if empty(opts.Auth.Username) || empty(opts.Auth.Password) {
+			return errors.New("auth.username and auth.password are required when auth.type is \"basic\".")
+		}
+	case "api_key":
+		if empty(opts.Auth.Key) {
+			return errors.New("auth.key is required when auth.type is \"api_key\".")
+		}
+	case "bearer":
+		if empty(opts.Auth.Token) {
+			return errors.New("auth.token is required when auth.type is \"bearer\".")
+		}
+	case "aws":
+		if empty(opts.Auth.AWS.Region) || empty(opts.Auth.AWS.Service) || empty(opts.Auth.AWS.AccessKey) || empty(opts.Auth.AWS.SecretKey) {
+			return errors.New("auth.aws.region, auth.aws.service, auth.aws.access_key, and auth.aws.secret_key are required when auth.type is \"aws\".")
+		}
+	default:
+		return fmt.Errorf("unknown auth.type %q.", opts.Auth.Type)
+	}
+
+	if opts.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(opts.MetricsAddr); err != nil {
+			return fmt.Errorf("metrics_addr %q is not a valid host:port address: %s", opts.MetricsAddr, err.Error())
+		}
+	}
+
 	return nil
 }
 
@@ -125,7 +230,12 @@ func print() {
 
 func setup(opts options) {
 	// Connect client
-	client, err := elastic.NewClient(elastic.SetURL(opts.URI), elastic.SetSniff(false))
+	httpClient, err := newElasticHTTPClient(opts)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	client, err := elastic.NewClient(elastic.SetURL(opts.URI), elastic.SetSniff(false), elastic.SetHttpClient(httpClient))
 
 	if err != nil {
 		log.Fatalln(err.Error())
@@ -159,6 +269,68 @@ func setup(opts options) {
 
 }
 
+// runSnapshot fetches the table in one pass, feeding every row through the
+// worker pool and the given bulk processor. Used both for the one-shot
+// "snapshot" mode and as the initial load CDC performs before it starts
+// streaming.
+func runSnapshot(db *sql.DB, opts options, processor *bulkProcessor, workers int) {
+
+	if opts.Slices > 1 {
+		runSlicedSnapshot(db, opts, processor, workers)
+		return
+	}
+
+	limit := "ALL"
+	if opts.MaxFetchRows > 0 {
+		limit = strconv.Itoa(opts.MaxFetchRows)
+	}
+
+	router, err := newDocRouter(opts)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	wg := new(sync.WaitGroup)
+
+	indexQ = make(chan string, opts.MaxBulkActions*workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go index(wg, processor, router)
+	}
+
+	//Postgres go library doesn't allow dynamic table placeholders
+	statement := fmt.Sprintf("SELECT row_to_json(t) FROM %s as t LIMIT %s", opts.DB.Table, limit)
+	rows, err := db.Query(statement)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var doc string
+		if err := rows.Scan(&doc); err != nil {
+			fmt.Println(err)
+		}
+		postgresRowsReadTotal.Inc()
+
+		// Block while the bulk processor is backing off from repeated
+		// transient failures, so indexQ doesn't grow without bound.
+		<-processor.Backoff()
+		indexQ <- doc
+		atomic.AddInt64(&queueDepth, 1)
+
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	close(indexQ)
+
+	wg.Wait()
+}
+
 func main() {
 
 	if len(os.Args) < 2 {
@@ -195,11 +367,6 @@ func main() {
 		opts.MaxBulkActions = 1000 // Default to 1000 insert actions at one time
 	}
 
-	limit := "ALL"
-	if opts.MaxFetchRows > 0 {
-		limit = strconv.Itoa(opts.MaxFetchRows)
-	}
-
 	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%d dbname=%s user=%s sslmode=disable password=%s", opts.DB.Host, opts.DB.Port, opts.DB.Database, opts.DB.User, opts.DB.Password))
 	if err != nil {
 		log.Fatalln(err.Error())
@@ -208,47 +375,40 @@ func main() {
 	// Setup index
 	setup(opts)
 
-	wg := new(sync.WaitGroup)
-
-	indexQ = make(chan string, opts.MaxBulkActions*workers)
-
-	for i := 0; i < workers; i++ {
-		wg.Add(1)
-		go index(wg, opts)
+	// Shared client and bulk processor; workers only drain indexQ into it.
+	httpClient, err := newElasticHTTPClient(opts)
+	if err != nil {
+		log.Fatalln(err.Error())
 	}
+	client, err := elastic.NewClient(elastic.SetURL(opts.URI), elastic.SetSniff(false), elastic.SetHttpClient(httpClient))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	processor := newBulkProcessor(client, opts)
+
+	startMetrics(opts, db, client)
 
+	// Without metrics_addr there's no other visibility into progress, so
+	// keep printing the terminal counter; with it, /metrics is the source
+	// of truth, but status still needs draining so bulk flushes don't block.
 	go func() {
 		for {
 			<-status
-			print()
+			if opts.MetricsAddr == "" {
+				print()
+			}
 		}
 	}()
 
-	//Postgres go library doesn't allow dynamic table placeholders
-	statement := fmt.Sprintf("SELECT row_to_json(t) FROM %s as t LIMIT %s", opts.DB.Table, limit)
-	rows, err := db.Query(statement)
-	if err != nil {
-		log.Fatalln(err.Error())
+	if opts.Mode == "cdc" {
+		runCDC(db, opts, processor, workers)
+	} else {
+		runSnapshot(db, opts, processor, workers)
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-
-		var doc string
-		if err := rows.Scan(&doc); err != nil {
-			fmt.Println(err)
-		}
 
-		indexQ <- doc
+	processor.Stop()
 
+	if opts.MetricsAddr == "" {
+		print() // Print last update
 	}
-	if err := rows.Err(); err != nil {
-		log.Fatalln(err.Error())
-	}
-
-	close(indexQ)
-
-	wg.Wait()
-
-	print() // Print last update
 }
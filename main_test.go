@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func validOptions() options {
+	var opts options
+	opts.Index = "widgets"
+	opts.Type = "_doc"
+	opts.URI = "http://localhost:9200"
+	opts.DB.Host = "localhost"
+	opts.DB.Port = 5432
+	opts.DB.User = "postgres"
+	opts.DB.Database = "app"
+	opts.DB.Password = "secret"
+	opts.DB.Table = "widgets"
+	return opts
+}
+
+func TestCheckValidOptions(t *testing.T) {
+	if err := check(validOptions()); err != nil {
+		t.Errorf("check() error = %v, want nil", err)
+	}
+}
+
+func TestCheckRejectsMetricsAddrWithoutPort(t *testing.T) {
+	opts := validOptions()
+	opts.MetricsAddr = "localhost"
+	if err := check(opts); err == nil {
+		t.Error("check() = nil, want error for metrics_addr without a port")
+	}
+}
+
+func TestCheckAcceptsMetricsAddrHostPort(t *testing.T) {
+	opts := validOptions()
+	opts.MetricsAddr = ":9090"
+	if err := check(opts); err != nil {
+		t.Errorf("check() error = %v, want nil", err)
+	}
+}
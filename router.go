@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// decodeRow parses a raw JSON row while preserving integer precision:
+// json.Unmarshal into map[string]interface{} decodes all numbers as
+// float64, which silently mangles bigint/bigserial ids over ~15 digits
+// into scientific notation. Every call site that turns a column value
+// into an _id, routing value, or resume checkpoint must go through this
+// (or columnString) instead of unmarshaling directly.
+func decodeRow(doc string) (map[string]interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	var row map[string]interface{}
+	if err := dec.Decode(&row); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// columnString formats a decodeRow value for use as an _id/routing/
+// checkpoint value, using json.Number's exact decimal string instead of
+// fmt's float formatting.
+func columnString(v interface{}) string {
+	if n, ok := v.(json.Number); ok {
+		return n.String()
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// docRouter derives the per-row index name, document id, routing value,
+// and op type from a row's own columns, instead of the fixed
+// opts.Index/opts.Type + OpType("create") every row used to get. This is
+// what makes re-indexing idempotent (an explicit _id means a re-run
+// updates the existing doc instead of 409ing on create) and makes
+// time-partitioned indices possible via IndexTemplate.
+type docRouter struct {
+	opts          options
+	indexTemplate *template.Template
+}
+
+// templateFuncs are available inside index_template. date formats a column
+// value (a time.Time, or a string/number time.Parse-able as RFC3339) using
+// a Go reference-time layout, e.g. {{.created_at | date "2006.01"}}.
+var templateFuncs = template.FuncMap{
+	"date": func(layout string, value interface{}) (string, error) {
+		switch v := value.(type) {
+		case time.Time:
+			return v.Format(layout), nil
+		case string:
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return "", fmt.Errorf("date: parsing %q as RFC3339: %s", v, err.Error())
+			}
+			return t.Format(layout), nil
+		default:
+			return "", fmt.Errorf("date: unsupported value type %T", value)
+		}
+	},
+}
+
+func newDocRouter(opts options) (*docRouter, error) {
+	r := &docRouter{opts: opts}
+
+	if opts.IndexTemplate != "" {
+		// missingkey=error turns a column absent from row (e.g. one outside
+		// a delete event's replica identity) into a hard error instead of
+		// text/template's default: silently rendering the literal string
+		// "<no value>" into the index name.
+		tmpl, err := template.New("index_template").Funcs(templateFuncs).Option("missingkey=error").Parse(opts.IndexTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("parsing index_template: %s", err.Error())
+		}
+		r.indexTemplate = tmpl
+	}
+
+	return r, nil
+}
+
+// route computes the index, id, routing, and op type to use for a single
+// raw JSON row. doc is returned unchanged; it's only parsed to evaluate
+// id_column/routing_column/index_template, not rewritten.
+func (r *docRouter) route(doc string) (index, id, routing, opType string, err error) {
+	index = r.opts.Index
+	opType = r.opts.OpType
+	if opType == "" {
+		opType = "create"
+	}
+
+	if r.opts.IDColumn == "" && r.opts.RoutingColumn == "" && r.indexTemplate == nil {
+		return index, "", "", opType, nil
+	}
+
+	row, err := decodeRow(doc)
+	if err != nil {
+		return "", "", "", "", fmt.Errorf("parsing row for routing: %s", err.Error())
+	}
+
+	if r.opts.IDColumn != "" {
+		if v, ok := row[r.opts.IDColumn]; ok {
+			id = columnString(v)
+		}
+	}
+
+	if r.opts.RoutingColumn != "" {
+		if v, ok := row[r.opts.RoutingColumn]; ok {
+			routing = columnString(v)
+		}
+	}
+
+	if r.indexTemplate != nil {
+		var buf bytes.Buffer
+		if err := r.indexTemplate.Execute(&buf, row); err != nil {
+			return "", "", "", "", fmt.Errorf("evaluating index_template: %s", err.Error())
+		}
+		index = buf.String()
+	}
+
+	return index, id, routing, opType, nil
+}
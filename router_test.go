@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestDocRouterRouteDefaults(t *testing.T) {
+	r, err := newDocRouter(options{Index: "widgets"})
+	if err != nil {
+		t.Fatalf("newDocRouter() error = %v", err)
+	}
+
+	index, id, routing, opType, err := r.route(`{"id":1}`)
+	if err != nil {
+		t.Fatalf("route() error = %v", err)
+	}
+	if index != "widgets" || id != "" || routing != "" || opType != "create" {
+		t.Errorf("route() = (%q, %q, %q, %q), want (\"widgets\", \"\", \"\", \"create\")", index, id, routing, opType)
+	}
+}
+
+func TestDocRouterRouteIDAndRoutingPreserveBigintPrecision(t *testing.T) {
+	r, err := newDocRouter(options{Index: "widgets", IDColumn: "id", RoutingColumn: "tenant_id", OpType: "upsert"})
+	if err != nil {
+		t.Fatalf("newDocRouter() error = %v", err)
+	}
+
+	index, id, routing, opType, err := r.route(`{"id":123456789012345,"tenant_id":7}`)
+	if err != nil {
+		t.Fatalf("route() error = %v", err)
+	}
+	if index != "widgets" || id != "123456789012345" || routing != "7" || opType != "upsert" {
+		t.Errorf("route() = (%q, %q, %q, %q), want (\"widgets\", \"123456789012345\", \"7\", \"upsert\")", index, id, routing, opType)
+	}
+}
+
+func TestDocRouterRouteIndexTemplate(t *testing.T) {
+	r, err := newDocRouter(options{Index: "widgets", IndexTemplate: "logs-{{.kind}}"})
+	if err != nil {
+		t.Fatalf("newDocRouter() error = %v", err)
+	}
+
+	index, _, _, _, err := r.route(`{"kind":"error"}`)
+	if err != nil {
+		t.Fatalf("route() error = %v", err)
+	}
+	if index != "logs-error" {
+		t.Errorf("route() index = %q, want %q", index, "logs-error")
+	}
+}
+
+func TestDocRouterRouteIndexTemplateMissingColumnErrors(t *testing.T) {
+	r, err := newDocRouter(options{Index: "widgets", IndexTemplate: "logs-{{.created_at}}"})
+	if err != nil {
+		t.Fatalf("newDocRouter() error = %v", err)
+	}
+
+	// A row missing a column the template references (e.g. a delete event
+	// whose oldkeys don't carry it) must error instead of silently
+	// rendering the literal "<no value>" into the index name.
+	if _, _, _, _, err := r.route(`{"kind":"error"}`); err == nil {
+		t.Fatal("route() error = nil, want error for missing index_template column")
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// runSlicedSnapshot partitions the initial load across opts.Slices
+// concurrent reader goroutines so a single Postgres backend isn't the
+// bottleneck ahead of the Elasticsearch worker pool. Slicing is done by
+// hashtext(id_column) when id_column is configured, or by ctid page range
+// otherwise. Each slice resumes from its own checkpoint in
+// slice_state_file when resume_from is configured, so an interrupted load
+// can restart without redoing finished slices from scratch.
+func runSlicedSnapshot(db *sql.DB, opts options, processor *bulkProcessor, workers int) {
+
+	router, err := newDocRouter(opts)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	workerWG := new(sync.WaitGroup)
+	indexQ = make(chan string, opts.MaxBulkActions*workers)
+	for i := 0; i < workers; i++ {
+		workerWG.Add(1)
+		go index(workerWG, processor, router)
+	}
+
+	checkpoint := loadSliceCheckpoint(opts.SliceStateFile)
+
+	ranges, err := sliceRanges(db, opts)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	readerWG := new(sync.WaitGroup)
+	for i, r := range ranges {
+		readerWG.Add(1)
+		go func(slice int, r sliceRange) {
+			defer readerWG.Done()
+			if err := scanSlice(db, opts, slice, r, checkpoint, processor); err != nil {
+				log.Println("scan slice", slice, ":", err.Error())
+			}
+		}(i, r)
+	}
+	readerWG.Wait()
+
+	close(indexQ)
+	workerWG.Wait()
+}
+
+// sliceRange is a half-open partition of the table: either a predicate on
+// hashtext(id_column) (PKFilter set) or a ctid page range (the fallback
+// when no id_column is configured).
+type sliceRange struct {
+	PKFilter   string
+	StartPage  int64
+	EndPage    int64 // -1 means "to the end of the table"
+	HasPKSlice bool
+}
+
+func sliceRanges(db *sql.DB, opts options) ([]sliceRange, error) {
+	ranges := make([]sliceRange, opts.Slices)
+
+	if opts.IDColumn != "" {
+		for i := range ranges {
+			ranges[i] = sliceRange{
+				HasPKSlice: true,
+				// hashtext() returns a signed int4, and Postgres's % takes
+				// the sign of the dividend, so a plain "hashtext(...) % n"
+				// lands negative hashes in [-(n-1), 0] - never matching any
+				// slice but 0. abs() normalizes the remainder into [0, n)
+				// so every row lands in exactly one slice.
+				PKFilter: fmt.Sprintf("abs(hashtext(%s::text)) %% %d = %d", opts.IDColumn, opts.Slices, i),
+			}
+		}
+		return ranges, nil
+	}
+
+	var relpages int64
+	row := db.QueryRow(fmt.Sprintf("SELECT relpages FROM pg_class WHERE oid = '%s'::regclass", opts.DB.Table))
+	if err := row.Scan(&relpages); err != nil {
+		return nil, fmt.Errorf("reading relpages for %s: %s", opts.DB.Table, err.Error())
+	}
+
+	for i := range ranges {
+		start := relpages * int64(i) / int64(opts.Slices)
+		end := relpages * int64(i+1) / int64(opts.Slices)
+		if i == len(ranges)-1 {
+			end = -1 // last slice runs to the end, covering any growth since relpages was read
+		}
+		ranges[i] = sliceRange{StartPage: start, EndPage: end}
+	}
+
+	return ranges, nil
+}
+
+func scanSlice(db *sql.DB, opts options, slice int, r sliceRange, checkpoint *sliceCheckpoint, processor *bulkProcessor) error {
+
+	where := r.PKFilter
+	if !r.HasPKSlice {
+		if r.EndPage < 0 {
+			where = fmt.Sprintf("ctid >= '(%d,0)'::tid", r.StartPage)
+		} else {
+			where = fmt.Sprintf("ctid >= '(%d,0)'::tid AND ctid < '(%d,0)'::tid", r.StartPage, r.EndPage)
+		}
+	}
+
+	// The resume checkpoint is row data (a PK or other column value), not a
+	// trusted literal, so it's bound as $1 rather than interpolated into
+	// the WHERE clause - a quoted string interpolation would both break on
+	// embedded quotes and open SQL injection.
+	var args []interface{}
+	if opts.ResumeFromColumn != "" {
+		if last, ok := checkpoint.get(slice); ok {
+			where = fmt.Sprintf("%s AND %s > $1", where, opts.ResumeFromColumn)
+			args = append(args, last)
+		}
+	}
+
+	statement := fmt.Sprintf("SELECT row_to_json(t) FROM %s as t WHERE %s", opts.DB.Table, where)
+	if opts.ResumeFromColumn != "" {
+		statement += fmt.Sprintf(" ORDER BY %s", opts.ResumeFromColumn)
+	}
+	if opts.MaxFetchRows > 0 {
+		statement += fmt.Sprintf(" LIMIT %d", opts.MaxFetchRows)
+	}
+
+	rows, err := db.Query(statement, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	const checkpointEvery = 1000
+	seen := 0
+
+	for rows.Next() {
+		var doc string
+		if err := rows.Scan(&doc); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		postgresRowsReadTotal.Inc()
+
+		<-processor.Backoff()
+		indexQ <- doc
+		atomic.AddInt64(&queueDepth, 1)
+
+		if opts.ResumeFromColumn != "" {
+			if v, err := resumeValue(doc, opts.ResumeFromColumn); err == nil {
+				seen++
+				checkpoint.set(slice, v, seen%checkpointEvery == 0)
+			}
+		}
+	}
+
+	if opts.ResumeFromColumn != "" {
+		checkpoint.flush()
+	}
+
+	return rows.Err()
+}
+
+func resumeValue(doc, column string) (string, error) {
+	row, err := decodeRow(doc)
+	if err != nil {
+		return "", err
+	}
+	return columnString(row[column]), nil
+}
+
+// sliceCheckpoint persists, per slice, the last value emitted for
+// resume_from, so an interrupted sliced load can resume each slice from
+// where it left off rather than rescanning the whole table.
+type sliceCheckpoint struct {
+	mu     sync.Mutex
+	path   string
+	Values map[string]string `json:"values"`
+}
+
+func loadSliceCheckpoint(path string) *sliceCheckpoint {
+	c := &sliceCheckpoint{path: path, Values: map[string]string{}}
+	if path == "" {
+		return c
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c
+	}
+	if err := json.Unmarshal(raw, c); err != nil {
+		log.Println("slice_state_file: ignoring unreadable checkpoint:", err.Error())
+	}
+	return c
+}
+
+func (c *sliceCheckpoint) get(slice int) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.Values[strconv.Itoa(slice)]
+	return v, ok
+}
+
+// set records value as slice's latest position, persisting to disk
+// immediately when persist is true (callers debounce this, e.g. every
+// Nth row) and always on flush.
+func (c *sliceCheckpoint) set(slice int, value string, persist bool) {
+	c.mu.Lock()
+	c.Values[strconv.Itoa(slice)] = value
+	c.mu.Unlock()
+
+	if persist {
+		c.flush()
+	}
+}
+
+func (c *sliceCheckpoint) flush() {
+	if c.path == "" {
+		return
+	}
+
+	c.mu.Lock()
+	raw, err := json.Marshal(c)
+	c.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	if err := ioutil.WriteFile(c.path, raw, 0644); err != nil {
+		log.Println("slice_state_file: failed to persist checkpoint:", err.Error())
+	}
+}
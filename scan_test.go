@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestSliceRangesPKFilter(t *testing.T) {
+	ranges, err := sliceRanges(nil, options{IDColumn: "id", Slices: 3})
+	if err != nil {
+		t.Fatalf("sliceRanges() error = %v", err)
+	}
+	if len(ranges) != 3 {
+		t.Fatalf("sliceRanges() returned %d ranges, want 3", len(ranges))
+	}
+
+	want := []string{
+		"abs(hashtext(id::text)) % 3 = 0",
+		"abs(hashtext(id::text)) % 3 = 1",
+		"abs(hashtext(id::text)) % 3 = 2",
+	}
+	for i, r := range ranges {
+		if !r.HasPKSlice {
+			t.Errorf("range %d: HasPKSlice = false, want true", i)
+		}
+		if r.PKFilter != want[i] {
+			t.Errorf("range %d: PKFilter = %q, want %q", i, r.PKFilter, want[i])
+		}
+	}
+}
+
+// TestSliceRangesPKFilterPartitionsNegativeHashes reproduces the PKFilter's
+// "abs(hashtext(id::text)) % slices = i" predicate in Go and checks every
+// hash - including negative ones, which hashtext() regularly returns since
+// it's a signed int4 - lands in exactly one slice. Before abs() was added,
+// "hashtext(...) % n" took the sign of the dividend, so negative hashes
+// landed in [-(n-1), 0] and matched no slice but 0, silently dropping
+// roughly half the table from a sliced load.
+func TestSliceRangesPKFilterPartitionsNegativeHashes(t *testing.T) {
+	const slices = 4
+	hashes := []int32{0, 1, -1, 7, -7, 2147483647, -2147483648, 42, -42}
+
+	pkSlice := func(hash int32) int {
+		r := int(hash) % slices
+		if r < 0 {
+			r = -r
+		}
+		return r
+	}
+
+	for _, h := range hashes {
+		matches := 0
+		for i := 0; i < slices; i++ {
+			if pkSlice(h) == i {
+				matches++
+			}
+		}
+		if matches != 1 {
+			t.Errorf("hash %d matched %d slices out of %d, want exactly 1", h, matches, slices)
+		}
+	}
+}